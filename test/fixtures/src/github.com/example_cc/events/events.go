@@ -0,0 +1,47 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package events serializes the chaincode events emitted by example_cc so
+// that SDK clients can register contract listeners for them.
+package events
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Event names emitted via stub.SetEvent. SDK clients register
+// contract.addContractListener callbacks against these.
+const (
+	CustomerCreated  = "customer.created"
+	CustomerDeleted  = "customer.deleted"
+	FundsTransferred = "funds.transferred"
+)
+
+// Payload is the JSON body attached to every ledger-change event
+type Payload struct {
+	TxID      string    `json:"txId"`
+	Sender    string    `json:"sender,omitempty"`
+	Recipient string    `json:"recipient,omitempty"`
+	Amount    int       `json:"amount,omitempty"`
+	Message   string    `json:"message,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Marshal serializes a Payload for use with stub.SetEvent
+func Marshal(p Payload) ([]byte, error) {
+	return json.Marshal(p)
+}
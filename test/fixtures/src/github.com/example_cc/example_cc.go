@@ -20,393 +20,756 @@ import (
 	"encoding/json"
 	"fmt"
 	"strconv"
+	"time"
 
-	"github.com/hyperledger/fabric/core/chaincode/shim"
-	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/example_cc/events"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/hyperledger/fabric-chaincode-go/pkg/cid"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
 )
 
-var logger = shim.NewLogger("example_cc0")
+// phoneNumberIndex is the name of the composite-key index that maps a
+// customer's phone number to their name for efficient lookup. The index
+// itself lives in privateCollection since it is keyed off PII.
+const phoneNumberIndex = "phoneNumber~name"
+
+// privateCollection holds the PII fields (phone number, account number,
+// transaction history) of a customer record, as configured by
+// collections_config.json. Only organizations named in that collection's
+// policy can read or write it.
+const privateCollection = "customerPrivateDetails"
+
+// customerTransientInput is the transient-map payload expected by
+// InitCustomer. Passing it via GetTransient keeps PII out of the proposal
+// and out of the ordered transaction recorded on the public ledger.
+type customerTransientInput struct {
+	Name          string `json:"name"`
+	AccountNumber string `json:"accountNumber"`
+	PhoneNumber   string `json:"phoneNumber"`
+	Balance       int    `json:"balance"`
+}
+
+// CustomerPrivateDetails holds the PII fields of a customer, stored only in
+// privateCollection
+type CustomerPrivateDetails struct {
+	ObjectType    string  `json:"docType"` //docType is used to distinguish the various types of objects in state database
+	Name          string  `json:"name"`
+	AccountNumber string  `json:"accountNumber"`
+	PhoneNumber   string  `json:"phoneNumber"`
+	History       history `json:"history"`
+}
 
-// SimpleChaincode example simple Chaincode implementation
-type SimpleChaincode struct {
+// adminRoleAttribute is the certificate attribute required to create or
+// administratively adjust customer records
+const adminRoleAttribute = "role"
+const adminRoleValue = "admin"
+
+// AuthorizationError is returned whenever a caller fails an identity or role
+// check, distinguishing it from validation errors so SDK clients can react
+// differently (e.g. surface a permission-denied message instead of retrying)
+type AuthorizationError struct {
+	Message string
 }
 
-type transaction struct {
+func (e *AuthorizationError) Error() string {
+	return e.Message
+}
+
+// Transaction records a single movement of funds against a customer's history
+type Transaction struct {
 	ObjectType string `json:"docType"` //docType is used to distinguish the various types of objects in state database
 	TxType     string `json:"txType"`
 	Amount     int    `json:"amount"`
 	Message    string `json:"message"`
 }
 
-type history []transaction
+type history []Transaction
+
+// TransferReceipt records the outcome of a Transfer against the
+// client-supplied clientTxnId that requested it, for off-chain reconciliation
+// and replay protection
+type TransferReceipt struct {
+	ClientTxnID string    `json:"clientTxnId"`
+	TxID        string    `json:"txId"`
+	Sender      string    `json:"sender"`
+	Recipient   string    `json:"recipient"`
+	Amount      int       `json:"amount"`
+	Timestamp   time.Time `json:"timestamp"`
+}
 
-type customer struct {
-	ObjectType    string  `json:"docType"` //docType is used to distinguish the various types of objects in state database
-	Name          string  `json:"name"`
-	AccountNumber string  `json:"accountNumber"`
-	PhoneNumber   string  `json:"phoneNumber"`
-	Balance       int     `json:"balance"`
-	History       history `json:"history"`
+// PaginatedQueryResult wraps a page of query results along with the CouchDB
+// bookmark needed to fetch the next page
+type PaginatedQueryResult struct {
+	Records             []Customer `json:"records"`
+	FetchedRecordsCount int32      `json:"fetchedRecordsCount"`
+	Bookmark            string     `json:"bookmark"`
 }
 
-// ===============================================
-// readCustomer - read a customer from chaincode state
-// ===============================================
-func (t *SimpleChaincode) readCustomer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	var name, jsonResp string
-	var err error
+// HistoryQueryResult represents a single entry in a customer's modification
+// history as returned by GetHistoryForKey
+type HistoryQueryResult struct {
+	TxId      string    `json:"txId"`
+	Timestamp time.Time `json:"timestamp"`
+	Record    *Customer `json:"record"`
+	IsDelete  bool      `json:"isDelete"`
+}
 
-	if len(args) != 1 {
-		return shim.Error("Incorrect number of arguments. Expecting name of the customer to query")
+// Customer is the public ledger representation of a bank customer. PII
+// (phone number, account number, transaction history) lives instead in
+// privateCollection as a CustomerPrivateDetails record. A phone number is a
+// small, enumerable keyspace, so no derivative of it - hashed or otherwise -
+// is kept in the public world state; verifying one always means reading
+// privateCollection, which only an authorized peer can do.
+type Customer struct {
+	ObjectType string `json:"docType"` //docType is used to distinguish the various types of objects in state database
+	Name       string `json:"name"`
+	Balance    int    `json:"balance"`
+	Owner      string `json:"owner"`
+}
+
+// SmartContract implements the customer/transfer chaincode using the
+// contract-api programming model
+type SmartContract struct {
+	contractapi.Contract
+}
+
+// InitCustomer creates a new customer record on the ledger. The PII
+// (accountNumber, phoneNumber) is supplied via the transient map under the
+// "customer" key rather than as a plain argument, so it is never written to
+// the proposal or the ordered transaction on the public channel ledger.
+func (s *SmartContract) InitCustomer(ctx contractapi.TransactionContextInterface) error {
+	fmt.Println("- start init customer")
+
+	if err := requireAdmin(ctx); err != nil {
+		return err
 	}
 
-	name = args[0]
-	valAsbytes, err := stub.GetState(name) //get the customer from chaincode state
+	transientMap, err := ctx.GetStub().GetTransient()
 	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get state for " + name + "\"}"
-		return shim.Error(jsonResp)
-	} else if valAsbytes == nil {
-		jsonResp = "{\"Error\":\"Marble does not exist: " + name + "\"}"
-		return shim.Error(jsonResp)
+		return fmt.Errorf("failed to get transient: %v", err)
+	}
+	transientJSON, ok := transientMap["customer"]
+	if !ok {
+		return fmt.Errorf("customer not found in the transient map")
 	}
 
-	return shim.Success(valAsbytes)
-}
+	var input customerTransientInput
+	if err := json.Unmarshal(transientJSON, &input); err != nil {
+		return fmt.Errorf("failed to unmarshal customer transient input: %v", err)
+	}
 
-func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
-	logger.Info("########### example_cc0 Init ###########")
+	if len(input.Name) <= 0 {
+		return fmt.Errorf("name must be a non-empty string")
+	}
+	if len(input.AccountNumber) <= 0 {
+		return fmt.Errorf("accountNumber must be a non-empty string")
+	}
+	if len(input.PhoneNumber) <= 0 {
+		return fmt.Errorf("phoneNumber must be a non-empty string")
+	}
 
-	_, args := stub.GetFunctionAndParameters()
-	var A, B string    // Entities
-	var Aval, Bval int // Asset holdings
-	var err error
+	existing, err := ctx.GetStub().GetState(input.Name)
+	if err != nil {
+		return fmt.Errorf("failed to get customer: %v", err)
+	} else if existing != nil {
+		return fmt.Errorf("this customer already exists: %s", input.Name)
+	}
 
-	// Initialize the chaincode
-	A = args[0]
-	Aval, err = strconv.Atoi(args[1])
+	owner, err := cid.GetID(ctx.GetStub())
 	if err != nil {
-		return shim.Error("Expecting integer value for asset holding")
+		return err
 	}
-	B = args[2]
-	Bval, err = strconv.Atoi(args[3])
+
+	customer := &Customer{
+		ObjectType: "customer",
+		Name:       input.Name,
+		Balance:    input.Balance,
+		Owner:      owner,
+	}
+	customerJSONasBytes, err := json.Marshal(customer)
 	if err != nil {
-		return shim.Error("Expecting integer value for asset holding")
+		return err
 	}
-	logger.Info("Aval = %d, Bval = %d\n", Aval, Bval)
 
-	// Write the state to the ledger
-	err = stub.PutState(A, []byte(strconv.Itoa(Aval)))
+	if err := ctx.GetStub().PutState(input.Name, customerJSONasBytes); err != nil {
+		return err
+	}
+
+	privateDetails := &CustomerPrivateDetails{
+		ObjectType:    "customerPrivateDetails",
+		Name:          input.Name,
+		AccountNumber: input.AccountNumber,
+		PhoneNumber:   input.PhoneNumber,
+		History:       history{},
+	}
+	privateDetailsJSONasBytes, err := json.Marshal(privateDetails)
 	if err != nil {
-		return shim.Error(err.Error())
+		return err
+	}
+	if err := ctx.GetStub().PutPrivateData(privateCollection, input.Name, privateDetailsJSONasBytes); err != nil {
+		return fmt.Errorf("failed to put customer private details: %v", err)
 	}
 
-	err = stub.PutState(B, []byte(strconv.Itoa(Bval)))
+	// ==== Index the customer by phone number so it can be looked up without
+	// a full scan of the customer docType. The index lives alongside the
+	// PII it's derived from. ====
+	phoneNameIndexKey, err := ctx.GetStub().CreateCompositeKey(phoneNumberIndex, []string{input.PhoneNumber, input.Name})
 	if err != nil {
-		return shim.Error(err.Error())
+		return err
+	}
+	if err := ctx.GetStub().PutPrivateData(privateCollection, phoneNameIndexKey, []byte{0x00}); err != nil {
+		return err
 	}
 
-	return shim.Success(nil)
+	if err := emitEvent(ctx, events.CustomerCreated, events.Payload{Recipient: input.Name}); err != nil {
+		return err
+	}
 
+	fmt.Println("- end init customer")
+	return nil
 }
 
-// Transaction makes payment of X units from A to B
-func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
-	logger.Info("########### example_cc0 Invoke ###########")
-
-	function, args := stub.GetFunctionAndParameters()
+// ReadCustomerPrivateDetails returns the PII collection record for name.
+// Only a caller that is the recorded owner, or an admin, may read it.
+func (s *SmartContract) ReadCustomerPrivateDetails(ctx contractapi.TransactionContextInterface, name string) (*CustomerPrivateDetails, error) {
+	customer, err := s.ReadCustomer(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if requireOwner(ctx, customer.Owner) != nil {
+		if err := requireAdmin(ctx); err != nil {
+			return nil, err
+		}
+	}
 
-	if function == "delete" {
-		// Deletes an entity from its state
-		return t.delete(stub, args)
+	detailsAsBytes, err := ctx.GetStub().GetPrivateData(privateCollection, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get private details for %s: %v", name, err)
+	}
+	if detailsAsBytes == nil {
+		return nil, fmt.Errorf("private details do not exist: %s", name)
 	}
 
-	if function == "query" {
-		// queries an entity state
-		return t.query(stub, args)
+	details := new(CustomerPrivateDetails)
+	if err := json.Unmarshal(detailsAsBytes, details); err != nil {
+		return nil, err
 	}
-	if function == "move" {
-		// Deletes an entity from its state
-		return t.move(stub, args)
+	return details, nil
+}
+
+// verifyRecipientPhoneNumber confirms phoneNumber matches the PII on file for
+// recipient by reading privateCollection directly - nothing derived from a
+// phone number is ever written to the public world state, so this check only
+// succeeds on a peer authorized to read the collection
+func (s *SmartContract) verifyRecipientPhoneNumber(ctx contractapi.TransactionContextInterface, recipient string, phoneNumber string) error {
+	detailsAsBytes, err := ctx.GetStub().GetPrivateData(privateCollection, recipient)
+	if err != nil {
+		return fmt.Errorf("failed to get private details for %s: %v", recipient, err)
 	}
-	if function == "transfer" {
-		return t.transfer(stub, args)
+	if detailsAsBytes == nil {
+		return fmt.Errorf("private details do not exist: %s", recipient)
 	}
 
-	logger.Errorf("Unknown action, check the first argument, must be one of 'delete', 'query', or 'move'. But got: %v", args[0])
-	return shim.Error(fmt.Sprintf("Unknown action, check the first argument, must be one of 'delete', 'query', or 'move'. But got: %v", args[0]))
+	details := new(CustomerPrivateDetails)
+	if err := json.Unmarshal(detailsAsBytes, details); err != nil {
+		return err
+	}
+	if phoneNumber != details.PhoneNumber {
+		return fmt.Errorf("phoneNumber is incorrect")
+	}
+	return nil
 }
 
-func (t *SimpleChaincode) initCustomer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	var err error
-	var balanceVal int
+// ReadCustomer returns the customer stored under name
+func (s *SmartContract) ReadCustomer(ctx contractapi.TransactionContextInterface, name string) (*Customer, error) {
+	customerAsBytes, err := ctx.GetStub().GetState(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get state for %s: %v", name, err)
+	}
+	if customerAsBytes == nil {
+		return nil, fmt.Errorf("customer does not exist: %s", name)
+	}
+
+	customer := new(Customer)
+	if err := json.Unmarshal(customerAsBytes, customer); err != nil {
+		return nil, err
+	}
+	return customer, nil
+}
 
-	//    0           1               2            3
-	// "name", "accountNumber", "phoneNumber", "balance"
-	if len(args) != 4 {
-		return shim.Error("Incorrect number of arguments. Expecting 4")
+// Move transfers amount units of a raw asset holding from one entity to another
+func (s *SmartContract) Move(ctx contractapi.TransactionContextInterface, from string, to string, amount int) error {
+	if err := requireAdmin(ctx); err != nil {
+		return err
 	}
 
-	// ==== Input sanitation ====
-	fmt.Println("- start init customer")
-	if len(args[0]) <= 0 {
-		return shim.Error("1st argument must be a non-empty string")
+	fromValBytes, err := ctx.GetStub().GetState(from)
+	if err != nil {
+		return fmt.Errorf("failed to get state: %v", err)
 	}
-	if len(args[1]) <= 0 {
-		return shim.Error("2nd argument must be a non-empty string")
+	if fromValBytes == nil {
+		return fmt.Errorf("entity not found: %s", from)
 	}
-	if len(args[2]) <= 0 {
-		return shim.Error("3rd argument must be a non-empty string")
+	fromVal, _ := strconv.Atoi(string(fromValBytes))
+
+	toValBytes, err := ctx.GetStub().GetState(to)
+	if err != nil {
+		return fmt.Errorf("failed to get state: %v", err)
 	}
-	if len(args[3]) <= 0 {
-		return shim.Error("4th argument must be a non-empty string")
+	if toValBytes == nil {
+		return fmt.Errorf("entity not found: %s", to)
 	}
+	toVal, _ := strconv.Atoi(string(toValBytes))
 
-	name := args[0]
-	accountNumber := args[1]
-	phoneNumber := args[2]
-	balance := args[3]
-	history := []transaction{}
+	fromVal = fromVal - amount
+	toVal = toVal + amount
 
-	// ==== Check if customer already exists ====
-	customerAsBytes, err := stub.GetState(name)
-	if err != nil {
-		return shim.Error("Failed to get customer: " + err.Error())
-	} else if customerAsBytes != nil {
-		fmt.Println("This customer already exists: " + name)
-		return shim.Error("This customer already exists: " + name)
+	if err := ctx.GetStub().PutState(from, []byte(strconv.Itoa(fromVal))); err != nil {
+		return err
+	}
+	if err := ctx.GetStub().PutState(to, []byte(strconv.Itoa(toVal))); err != nil {
+		return err
 	}
 
-	balanceVal, _ = strconv.Atoi(balance)
+	return emitEvent(ctx, events.FundsTransferred, events.Payload{Sender: from, Recipient: to, Amount: amount})
+}
 
-	// ==== Create customer object and marshal to JSON ====
-	objectType := "customer"
-	customer := &customer{objectType, name, accountNumber, phoneNumber, balanceVal, history}
-	customerJSONasBytes, err := json.Marshal(customer)
+// Transfer moves amount from sender to recipient after confirming phoneNumber
+// matches the recipient on record, and records the movement in both
+// customers' private transaction history. clientTxnId is a client-generated
+// idempotency key: a resubmitted proposal carrying an already-seen
+// clientTxnId is rejected rather than double-spent. phoneNumber is a plain
+// argument, so unlike InitCustomer's transient input it is recorded in the
+// ordered transaction on the channel ledger.
+func (s *SmartContract) Transfer(ctx contractapi.TransactionContextInterface, sender string, recipient string, amount int, phoneNumber string, msg string, clientTxnId string) (*Transaction, error) {
+	if amount <= 0 {
+		return nil, fmt.Errorf("amount must be a positive integer")
+	}
+	if len(clientTxnId) <= 0 {
+		return nil, fmt.Errorf("clientTxnId must be a non-empty string")
+	}
+	if sender == recipient {
+		return nil, fmt.Errorf("sender and recipient must be different customers")
+	}
+
+	receiptKey, err := transferReceiptKey(ctx, clientTxnId)
 	if err != nil {
-		return shim.Error(err.Error())
+		return nil, err
+	}
+	existingReceipt, err := ctx.GetStub().GetState(receiptKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transfer receipt: %v", err)
+	}
+	if existingReceipt != nil {
+		return nil, fmt.Errorf("transfer already processed for clientTxnId: %s", clientTxnId)
 	}
 
-	// === Save customer to state ===
-	err = stub.PutState(name, customerJSONasBytes)
+	senderCustomer, err := s.ReadCustomer(ctx, sender)
 	if err != nil {
-		return shim.Error(err.Error())
+		return nil, fmt.Errorf("failed to get sender: %v", err)
 	}
 
-	// ==== Customer saved. Return success ====
-	fmt.Println("- end init customer")
-	return shim.Success(nil)
+	if err := requireOwner(ctx, senderCustomer.Owner); err != nil {
+		return nil, err
+	}
 
-}
+	recipientCustomer, err := s.ReadCustomer(ctx, recipient)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get recipient: %v", err)
+	}
 
-func (t *SimpleChaincode) move(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	// must be an invoke
-	var A, B string    // Entities
-	var Aval, Bval int // Asset holdings
-	var X int          // Transaction value
-	var err error
+	if err := s.verifyRecipientPhoneNumber(ctx, recipient, phoneNumber); err != nil {
+		return nil, err
+	}
 
-	if len(args) != 3 {
-		return shim.Error("Incorrect number of arguments. Expecting 4, function followed by 2 names and 1 value")
+	if senderCustomer.Balance-amount < 0 {
+		return nil, fmt.Errorf("insufficient balance: %s has %d, tried to send %d", sender, senderCustomer.Balance, amount)
 	}
 
-	A = args[0]
-	B = args[1]
+	senderCustomer.Balance = senderCustomer.Balance - amount
+	recipientCustomer.Balance = recipientCustomer.Balance + amount
 
-	// Get the state from the ledger
-	// TODO: will be nice to have a GetAllState call to ledger
-	Avalbytes, err := stub.GetState(A)
-	if err != nil {
-		return shim.Error("Failed to get state")
+	outgoing := Transaction{ObjectType: "transaction", TxType: "出金", Amount: amount, Message: msg}
+	incoming := Transaction{ObjectType: "transaction", TxType: "入金", Amount: amount, Message: msg}
+
+	if err := s.appendPrivateHistory(ctx, sender, outgoing); err != nil {
+		return nil, err
 	}
-	if Avalbytes == nil {
-		return shim.Error("Entity not found")
+	if err := s.appendPrivateHistory(ctx, recipient, incoming); err != nil {
+		return nil, err
 	}
-	Aval, _ = strconv.Atoi(string(Avalbytes))
 
-	Bvalbytes, err := stub.GetState(B)
+	senderJSONasBytes, err := json.Marshal(senderCustomer)
 	if err != nil {
-		return shim.Error("Failed to get state")
+		return nil, err
 	}
-	if Bvalbytes == nil {
-		return shim.Error("Entity not found")
+	if err := ctx.GetStub().PutState(senderCustomer.Name, senderJSONasBytes); err != nil {
+		return nil, err
 	}
-	Bval, _ = strconv.Atoi(string(Bvalbytes))
 
-	// Perform the execution
-	X, err = strconv.Atoi(args[2])
+	recipientJSONasBytes, err := json.Marshal(recipientCustomer)
 	if err != nil {
-		return shim.Error("Invalid transaction amount, expecting a integer value")
+		return nil, err
+	}
+	if err := ctx.GetStub().PutState(recipientCustomer.Name, recipientJSONasBytes); err != nil {
+		return nil, err
 	}
-	Aval = Aval - X
-	Bval = Bval + X
-	logger.Infof("Aval = %d, Bval = %d\n", Aval, Bval)
 
-	// Write the state back to the ledger
-	err = stub.PutState(A, []byte(strconv.Itoa(Aval)))
-	if err != nil {
-		return shim.Error(err.Error())
+	if err := s.putTransferReceipt(ctx, clientTxnId, sender, recipient, amount); err != nil {
+		return nil, err
 	}
 
-	err = stub.PutState(B, []byte(strconv.Itoa(Bval)))
-	if err != nil {
-		return shim.Error(err.Error())
+	if err := emitEvent(ctx, events.FundsTransferred, events.Payload{Sender: sender, Recipient: recipient, Amount: amount, Message: msg}); err != nil {
+		return nil, err
 	}
 
-	return shim.Success(nil)
+	fmt.Println("- end transfer (success)")
+	return &outgoing, nil
 }
 
-func (t *SimpleChaincode) transfer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	// must be an invoke
-	var A, B, phoneNumber, msg string // Entities
-	var Aval, Bval int                // Asset holdings
-	var X int                         // Transaction value
-	var err error
-
-	if len(args) != 5 {
-		return shim.Error("Incorrect number of arguments. Expecting 5, function followed by 2 names and 3 value")
+// GetTransferReceipt returns the receipt recorded for clientTxnId so an
+// off-chain system can reconcile a transfer against the endorsed tx that
+// committed it
+func (s *SmartContract) GetTransferReceipt(ctx contractapi.TransactionContextInterface, clientTxnId string) (*TransferReceipt, error) {
+	receiptKey, err := transferReceiptKey(ctx, clientTxnId)
+	if err != nil {
+		return nil, err
 	}
 
-	A = args[0]
-	B = args[1]
-
-	phoneNumber = args[3]
-	logger.Infof("Passed phoneNumber: %s\n", phoneNumber)
+	receiptAsBytes, err := ctx.GetStub().GetState(receiptKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transfer receipt: %v", err)
+	}
+	if receiptAsBytes == nil {
+		return nil, fmt.Errorf("no transfer receipt found for clientTxnId: %s", clientTxnId)
+	}
 
-	msg = args[4]
-	logger.Infof("Passed message: %s\n", msg)
+	receipt := new(TransferReceipt)
+	if err := json.Unmarshal(receiptAsBytes, receipt); err != nil {
+		return nil, err
+	}
+	return receipt, nil
+}
 
-	senderAsBytes, err := stub.GetState(A)
+// putTransferReceipt records the endorsed txID and transaction timestamp of a
+// successful transfer under its clientTxnId, guarding against replay. The
+// timestamp is the one GetTxTimestamp reads from the transaction header, not
+// the commit time of the block that holds the transaction.
+func (s *SmartContract) putTransferReceipt(ctx contractapi.TransactionContextInterface, clientTxnId string, sender string, recipient string, amount int) error {
+	txTimestamp, err := ctx.GetStub().GetTxTimestamp()
 	if err != nil {
-		return shim.Error("Failed to get sender: " + err.Error())
-	} else if senderAsBytes != nil {
-		fmt.Println("Sender was found: " + A)
+		return err
+	}
+	timestamp, err := ptypes.Timestamp(txTimestamp)
+	if err != nil {
+		return err
 	}
 
-	recipientAsBytes, err := stub.GetState(B)
+	receipt := &TransferReceipt{
+		ClientTxnID: clientTxnId,
+		TxID:        ctx.GetStub().GetTxID(),
+		Sender:      sender,
+		Recipient:   recipient,
+		Amount:      amount,
+		Timestamp:   timestamp,
+	}
+	receiptAsBytes, err := json.Marshal(receipt)
 	if err != nil {
-		return shim.Error("Failed to get recipient: " + err.Error())
-	} else if recipientAsBytes != nil {
-		fmt.Println("Recipient was found: " + B)
+		return err
 	}
 
-	// sender check
-	sender := customer{}
-	err = json.Unmarshal(senderAsBytes, &sender) //unmarshal it aka JSON.parse()
+	receiptKey, err := transferReceiptKey(ctx, clientTxnId)
 	if err != nil {
-		return shim.Error(err.Error())
+		return err
 	}
+	return ctx.GetStub().PutState(receiptKey, receiptAsBytes)
+}
+
+// transferReceiptKey namespaces transfer receipts as a composite key so they
+// can never collide with a customer key, which is a plain state key, or with
+// the phoneNumber~name index, which lives in privateCollection
+func transferReceiptKey(ctx contractapi.TransactionContextInterface, clientTxnId string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey("txn~clientTxnId", []string{clientTxnId})
+}
 
-	// recipent check
-	recipient := customer{}
-	err = json.Unmarshal(recipientAsBytes, &recipient) //unmarshal it aka JSON.parse()
+// appendPrivateHistory records txn against name's private details
+func (s *SmartContract) appendPrivateHistory(ctx contractapi.TransactionContextInterface, name string, txn Transaction) error {
+	detailsAsBytes, err := ctx.GetStub().GetPrivateData(privateCollection, name)
 	if err != nil {
-		return shim.Error(err.Error())
+		return fmt.Errorf("failed to get private details for %s: %v", name, err)
+	}
+	if detailsAsBytes == nil {
+		return fmt.Errorf("private details do not exist: %s", name)
 	}
 
-	// confirm if phoneNumber is correct
-	if phoneNumber != recipient.PhoneNumber {
-		return shim.Error("PhoneNumber is incorrect: " + err.Error())
+	details := new(CustomerPrivateDetails)
+	if err := json.Unmarshal(detailsAsBytes, details); err != nil {
+		return err
 	}
+	details.History = append(details.History, txn)
 
-	Aval = sender.Balance
-	Bval = recipient.Balance
+	updatedAsBytes, err := json.Marshal(details)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutPrivateData(privateCollection, name, updatedAsBytes)
+}
 
-	// Perform the execution
-	X, err = strconv.Atoi(args[2])
+// Delete removes an entity from state. If key has a CustomerPrivateDetails
+// record in privateCollection, that record and its phoneNumber~name index
+// entry are purged as well, so no PII outlives the public customer doc.
+func (s *SmartContract) Delete(ctx contractapi.TransactionContextInterface, key string) error {
+	if err := requireAdmin(ctx); err != nil {
+		return err
+	}
+
+	privateDetailsAsBytes, err := ctx.GetStub().GetPrivateData(privateCollection, key)
 	if err != nil {
-		return shim.Error("Invalid transaction amount, expecting a integer value")
+		return fmt.Errorf("failed to get private details for %s: %v", key, err)
 	}
-	Aval = Aval - X
-	Bval = Bval + X
-	logger.Infof("Aval = %d, Bval = %d\n", Aval, Bval)
+	if privateDetailsAsBytes != nil {
+		details := new(CustomerPrivateDetails)
+		if err := json.Unmarshal(privateDetailsAsBytes, details); err != nil {
+			return err
+		}
 
-	sender.Balance = Aval
-	recipient.Balance = Bval
+		phoneNameIndexKey, err := ctx.GetStub().CreateCompositeKey(phoneNumberIndex, []string{details.PhoneNumber, key})
+		if err != nil {
+			return err
+		}
+		if err := ctx.GetStub().DelPrivateData(privateCollection, phoneNameIndexKey); err != nil {
+			return fmt.Errorf("failed to delete phone number index for %s: %v", key, err)
+		}
+
+		if err := ctx.GetStub().DelPrivateData(privateCollection, key); err != nil {
+			return fmt.Errorf("failed to delete private details for %s: %v", key, err)
+		}
+	}
 
-	// ObjectType           string `json:"docType"` //docType is used to distinguish the various types of objects in state database
-	// SenderName           string `json:"senderName"`
-	// RecipientName        string `json:"recipientName"`
-	// RecipientPhoneNumber string `json:"recipientPhoneNumber"`
-	// Amount               int    `json:"amount"`
-	// Message              string `json:"message"`
+	if err := ctx.GetStub().DelState(key); err != nil {
+		return fmt.Errorf("failed to delete state: %v", err)
+	}
 
-	// TODO: transaction to history
-	objectType := "transaction"
-	transactionA := &transaction{objectType, "出金", X, msg}
-	transactionB := &transaction{objectType, "入金", X, msg}
+	return emitEvent(ctx, events.CustomerDeleted, events.Payload{Recipient: key})
+}
 
-	sender.History = append(sender.History, *transactionA)
-	recipient.History = append(recipient.History, *transactionB)
+// Query returns the raw integer value held at key
+func (s *SmartContract) Query(ctx contractapi.TransactionContextInterface, key string) (int, error) {
+	valBytes, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get state for %s: %v", key, err)
+	}
+	if valBytes == nil {
+		return 0, fmt.Errorf("nil amount for %s", key)
+	}
 
-	senderJSONasBytes, _ := json.Marshal(sender)
-	err = stub.PutState(sender.Name, senderJSONasBytes) //rewrite the sender
+	val, err := strconv.Atoi(string(valBytes))
 	if err != nil {
-		return shim.Error(err.Error())
+		return 0, err
 	}
+	return val, nil
+}
 
-	recipientJSONasBytes, _ := json.Marshal(recipient)
-	err = stub.PutState(recipient.Name, recipientJSONasBytes) //rewrite the sender
+// QueryByPhoneNumber looks up the customer registered under phoneNumber using
+// the phoneNumber~name composite-key index kept in privateCollection,
+// avoiding a scan of every customer. Only organizations in the collection's
+// policy can resolve a result.
+func (s *SmartContract) QueryByPhoneNumber(ctx contractapi.TransactionContextInterface, phoneNumber string) ([]Customer, error) {
+	resultsIterator, err := ctx.GetStub().GetPrivateDataByPartialCompositeKey(privateCollection, phoneNumberIndex, []string{phoneNumber})
 	if err != nil {
-		return shim.Error(err.Error())
+		return nil, err
 	}
+	defer resultsIterator.Close()
 
-	// To return transaction result
-	transactionJSONasBytes, _ := json.Marshal(transactionA)
+	var customers []Customer
+	for resultsIterator.HasNext() {
+		kv, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
 
-	fmt.Println("- end transfer (success)")
-	return shim.Success(transactionJSONasBytes)
+		_, keyParts, err := ctx.GetStub().SplitCompositeKey(kv.Key)
+		if err != nil {
+			return nil, err
+		}
+		name := keyParts[1]
+
+		customer, err := s.ReadCustomer(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		customers = append(customers, *customer)
+	}
 
+	return customers, nil
 }
 
-// Deletes an entity from state
-func (t *SimpleChaincode) delete(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	if len(args) != 1 {
-		return shim.Error("Incorrect number of arguments. Expecting 1")
+// QueryCustomersByField runs a CouchDB rich query selecting customer docs
+// whose field matches value
+func (s *SmartContract) QueryCustomersByField(ctx contractapi.TransactionContextInterface, field string, value string) ([]Customer, error) {
+	// docType is combined via $and, rather than as a sibling key in the same
+	// selector map, so a caller passing field == "docType" can never collapse
+	// the two conditions into one and drop the customer-type restriction
+	queryStringAsBytes, err := json.Marshal(map[string]interface{}{
+		"selector": map[string]interface{}{
+			"$and": []map[string]interface{}{
+				{"docType": "customer"},
+				{field: value},
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	A := args[0]
+	resultsIterator, err := ctx.GetStub().GetQueryResult(string(queryStringAsBytes))
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	return constructCustomersFromIterator(resultsIterator)
+}
 
-	// Delete the key from the state in ledger
-	err := stub.DelState(A)
+// QueryCustomersWithPagination runs a CouchDB rich query and returns at most
+// pageSize records starting from bookmark, along with the bookmark to
+// continue from on the next call
+func (s *SmartContract) QueryCustomersWithPagination(ctx contractapi.TransactionContextInterface, queryString string, pageSize int32, bookmark string) (*PaginatedQueryResult, error) {
+	resultsIterator, responseMetadata, err := ctx.GetStub().GetQueryResultWithPagination(queryString, pageSize, bookmark)
 	if err != nil {
-		return shim.Error("Failed to delete state")
+		return nil, err
 	}
+	defer resultsIterator.Close()
+
+	customers, err := constructCustomersFromIterator(resultsIterator)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PaginatedQueryResult{
+		Records:             customers,
+		FetchedRecordsCount: responseMetadata.FetchedRecordsCount,
+		Bookmark:            responseMetadata.Bookmark,
+	}, nil
+}
 
-	return shim.Success(nil)
+// GetCustomerHistory returns the full modification history of name, oldest
+// entry first, as recorded by the ledger's block height and tx ordering
+func (s *SmartContract) GetCustomerHistory(ctx contractapi.TransactionContextInterface, name string) ([]HistoryQueryResult, error) {
+	resultsIterator, err := ctx.GetStub().GetHistoryForKey(name)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var records []HistoryQueryResult
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var customer Customer
+		if len(response.Value) > 0 {
+			if err := json.Unmarshal(response.Value, &customer); err != nil {
+				return nil, err
+			}
+		}
+
+		timestamp, err := ptypes.Timestamp(response.Timestamp)
+		if err != nil {
+			return nil, err
+		}
+
+		records = append(records, HistoryQueryResult{
+			TxId:      response.TxId,
+			Timestamp: timestamp,
+			Record:    &customer,
+			IsDelete:  response.IsDelete,
+		})
+	}
+
+	return records, nil
 }
 
-// Query callback representing the query of a chaincode
-func (t *SimpleChaincode) query(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+// requireAdmin rejects the invocation unless the caller's certificate
+// carries the admin role attribute
+func requireAdmin(ctx contractapi.TransactionContextInterface) error {
+	role, ok, err := cid.GetAttributeValue(ctx.GetStub(), adminRoleAttribute)
+	if err != nil {
+		return err
+	}
+	if !ok || role != adminRoleValue {
+		return &AuthorizationError{Message: "caller does not have the required admin role"}
+	}
+	return nil
+}
 
-	var A string // Entities
-	var err error
+// requireOwner rejects the invocation unless the caller's identity matches
+// the owner recorded on the customer being acted on
+func requireOwner(ctx contractapi.TransactionContextInterface, owner string) error {
+	callerID, err := cid.GetID(ctx.GetStub())
+	if err != nil {
+		return err
+	}
+	if callerID != owner {
+		return &AuthorizationError{Message: "caller is not the owner of this record"}
+	}
+	return nil
+}
 
-	if len(args) != 1 {
-		return shim.Error("Incorrect number of arguments. Expecting name of the person to query")
+// emitEvent stamps payload with the current tx ID and timestamp and sets it
+// as a chaincode event under name
+func emitEvent(ctx contractapi.TransactionContextInterface, name string, payload events.Payload) error {
+	txTimestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return err
+	}
+	timestamp, err := ptypes.Timestamp(txTimestamp)
+	if err != nil {
+		return err
 	}
 
-	A = args[0]
+	payload.TxID = ctx.GetStub().GetTxID()
+	payload.Timestamp = timestamp
 
-	// Get the state from the ledger
-	Avalbytes, err := stub.GetState(A)
+	payloadBytes, err := events.Marshal(payload)
 	if err != nil {
-		jsonResp := "{\"Error\":\"Failed to get state for " + A + "\"}"
-		return shim.Error(jsonResp)
+		return err
 	}
 
-	if Avalbytes == nil {
-		jsonResp := "{\"Error\":\"Nil amount for " + A + "\"}"
-		return shim.Error(jsonResp)
+	return ctx.GetStub().SetEvent(name, payloadBytes)
+}
+
+// constructCustomersFromIterator drains a state query iterator into a slice
+// of customers
+func constructCustomersFromIterator(resultsIterator shim.StateQueryIteratorInterface) ([]Customer, error) {
+	var customers []Customer
+	for resultsIterator.HasNext() {
+		queryResult, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		customer := new(Customer)
+		if err := json.Unmarshal(queryResult.Value, customer); err != nil {
+			return nil, err
+		}
+		customers = append(customers, *customer)
 	}
 
-	jsonResp := "{\"Name\":\"" + A + "\",\"Amount\":\"" + string(Avalbytes) + "\"}"
-	logger.Infof("Query Response:%s\n", jsonResp)
-	return shim.Success(Avalbytes)
+	return customers, nil
 }
 
 func main() {
-	err := shim.Start(new(SimpleChaincode))
+	chaincode, err := contractapi.NewChaincode(new(SmartContract))
 	if err != nil {
-		logger.Errorf("Error starting Simple chaincode: %s", err)
+		fmt.Printf("Error creating example chaincode: %s", err.Error())
+		return
+	}
+
+	if err := chaincode.Start(); err != nil {
+		fmt.Printf("Error starting example chaincode: %s", err.Error())
 	}
 }